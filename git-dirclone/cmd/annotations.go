@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	ciProviderGitHub = "github"
+	ciProviderAzure  = "azure"
+)
+
+// detectCIProvider returns the CI system the run is part of. GitHub's
+// annotation format is used unless another supported system is detected.
+func detectCIProvider() string {
+
+	if strings.EqualFold(os.Getenv("TF_BUILD"), "true") {
+		return ciProviderAzure
+	}
+
+	return ciProviderGitHub
+}
+
+// writeAnnotation writes message as an annotation of the given level, "error"
+// or "warning", in the format of the CI provider.
+func writeAnnotation(w io.Writer, provider string, level string, message string) {
+
+	switch provider {
+	case ciProviderAzure:
+		message = strings.NewReplacer("%", "%AZP25", "\r", "%AZP0D", "\n", "%AZP0A").Replace(message)
+		_, _ = fmt.Fprintf(w, "##vso[task.logissue type=%s]%s\n", level, message)
+	default:
+		message = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(message)
+		_, _ = fmt.Fprintf(w, "::%s::%s\n", level, message)
+	}
+}
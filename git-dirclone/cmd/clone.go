@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/whilp/git-urls"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// cloneOptions holds the settings shared by all clones of a single run.
+type cloneOptions struct {
+	rootDir           string
+	baseDir           string
+	token             string
+	env               []string
+	idleTimeout       time.Duration
+	shallowSince      string
+	recurseSubmodules bool
+	minFreeDisk       uint64
+	interrupted       <-chan struct{}
+	stdout            io.Writer
+	stderr            io.Writer
+}
+
+// cloneRepo clones the repository at rawURL below the root directory using
+// the URL path as directory structure.
+func cloneRepo(rawURL string, opts cloneOptions) error {
+
+	urlObj, err := giturls.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	var env []string
+	if opts.env != nil {
+		// Later entries win, so the file overrides the process environment
+		env = append(os.Environ(), opts.env...)
+	}
+
+	// The token is only sent over https. Plain http would expose it on the wire
+	if opts.token != "" && urlObj.Scheme == "https" {
+		if env == nil {
+			env = os.Environ()
+		}
+
+		// Passed through the environment, so the header is used for this
+		// invocation only, never written to the cloned repository's config and
+		// not visible in the process list. Submodule clones inherit it, so the
+		// header is scoped to the clone's origin
+		env = withGitConfigEnv(env, fmt.Sprintf("http.https://%s/.extraHeader", urlObj.Host), "Authorization: Bearer "+opts.token)
+	}
+
+	gitArgs := []string{"clone"}
+	if opts.idleTimeout > 0 {
+		// git only reports progress to a terminal unless asked to. Output is
+		// piped through the idle watchdog, so force it to keep it alive
+		gitArgs = append(gitArgs, "--progress")
+	}
+	if opts.shallowSince != "" {
+		gitArgs = append(gitArgs, "--shallow-since="+opts.shallowSince)
+	}
+	if opts.recurseSubmodules {
+		gitArgs = append(gitArgs, "--recurse-submodules")
+	}
+	repoDir := path.Join(opts.rootDir, urlObj.Host, strings.TrimSuffix(urlObj.Path, ".git"))
+	gitArgs = append(gitArgs, rawURL, repoDir)
+
+	if opts.minFreeDisk > 0 {
+		if err := checkFreeDiskSpace(repoDir, opts.minFreeDisk); err != nil {
+			return err
+		}
+	}
+
+	gitCmd := exec.Command("git", gitArgs...)
+	// Run git from the base directory as well, so relative local URLs
+	// resolve the same way the root does
+	gitCmd.Dir = opts.baseDir
+	gitCmd.Env = env
+	gitCmd.Stdout = opts.stdout
+	gitCmd.Stderr = opts.stderr
+
+	_, statErr := os.Stat(repoDir)
+	existed := statErr == nil
+
+	err = runWithIdleTimeout(gitCmd, opts.idleTimeout, opts.interrupted)
+	if (errors.Is(err, errIdleTimeout) || errors.Is(err, errInterrupted)) && !existed {
+		// git can't clean up after itself when it had to be killed
+		_ = os.RemoveAll(repoDir)
+	}
+
+	return err
+}
+
+// withGitConfigEnv returns env with the git config key set to value through
+// GIT_CONFIG_COUNT, GIT_CONFIG_KEY_<n> and GIT_CONFIG_VALUE_<n>. Entries
+// already configured in env, e.g. by an env file, are kept.
+func withGitConfigEnv(env []string, key string, value string) []string {
+
+	count := 0
+	for _, entry := range env {
+		if strings.HasPrefix(entry, "GIT_CONFIG_COUNT=") {
+			if n, err := strconv.Atoi(strings.TrimPrefix(entry, "GIT_CONFIG_COUNT=")); err == nil {
+				count = n
+			}
+		}
+	}
+
+	return append(env,
+		fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", count, key),
+		fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", count, value),
+		fmt.Sprintf("GIT_CONFIG_COUNT=%d", count+1),
+	)
+}
+
+// cloneRepos clones all given URLs running at most jobs clones at once. It
+// returns one error per URL, nil for successful clones.
+func cloneRepos(rawURLs []string, jobs int, opts cloneOptions) []error {
+
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	if jobs > 1 {
+		opts.stdout = newLockedWriter(opts.stdout)
+		opts.stderr = newLockedWriter(opts.stderr)
+	}
+
+	if opts.idleTimeout > 0 {
+		// git runs in its own process group and no longer gets the terminal's
+		// interrupts. Stop all clones here instead, so none is left behind
+		interrupted := make(chan struct{})
+		opts.interrupted = interrupted
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(signals)
+
+		finished := make(chan struct{})
+		defer close(finished)
+
+		go func() {
+			select {
+			case <-signals:
+				close(interrupted)
+			case <-finished:
+			}
+		}()
+	}
+
+	errs := make([]error, len(rawURLs))
+	sem := make(chan struct{}, jobs)
+
+	var wg sync.WaitGroup
+	for i, rawURL := range rawURLs {
+		select {
+		case sem <- struct{}{}:
+		case <-opts.interrupted:
+			errs[i] = errInterrupted
+			continue
+		}
+
+		// A free slot and an interrupt can be ready at the same time
+		select {
+		case <-opts.interrupted:
+			<-sem
+			errs[i] = errInterrupted
+			continue
+		default:
+		}
+
+		wg.Add(1)
+		go func(i int, rawURL string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = cloneRepo(rawURL, opts)
+		}(i, rawURL)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// lockedWriter serializes writes of concurrent clones to a shared writer.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newLockedWriter wraps w unless it is a file. Files are handed to git as they
+// are, which keeps git's terminal detection working and is safe for concurrent use.
+func newLockedWriter(w io.Writer) io.Writer {
+
+	if _, ok := w.(*os.File); ok {
+		return w
+	}
+
+	return &lockedWriter{w: w}
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.w.Write(p)
+}
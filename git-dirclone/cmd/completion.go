@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+)
+
+func newCompletionCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "completion [bash|zsh|fish|powershell]",
+		Short: "generate the autocompletion script for the specified shell",
+		Long: `Generate the autocompletion script for the specified shell.
+
+To load completions in your current bash session:
+$ source <(git-dirclone completion bash)
+
+To load completions for every new zsh session, execute once:
+$ git-dirclone completion zsh > "${fpath[1]}/_git-dirclone"
+
+To load completions for every new fish session, execute once:
+$ git-dirclone completion fish > ~/.config/fish/completions/git-dirclone.fish`,
+		DisableFlagsInUseLine: true,
+		ValidArgs:             []string{"bash", "zsh", "fish", "powershell"},
+		Args:                  cobra.ExactValidArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			out := cmd.OutOrStdout()
+
+			switch args[0] {
+			case "bash":
+				return cmd.Root().GenBashCompletionV2(out, true)
+			case "zsh":
+				return cmd.Root().GenZshCompletion(out)
+			case "fish":
+				return cmd.Root().GenFishCompletion(out, true)
+			case "powershell":
+				return cmd.Root().GenPowerShellCompletionWithDesc(out)
+			}
+
+			return fmt.Errorf("unsupported shell %q", args[0])
+		},
+	}
+}
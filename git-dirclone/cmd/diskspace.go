@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// freeDiskSpace reports the bytes available to unprivileged users on the
+// filesystem of the given directory. It is a variable so tests can stub it.
+var freeDiskSpace = diskFree
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  uint64
+}{
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+}
+
+// parseSize parses sizes like "512M" or "10G". Units are powers of 1024 and
+// a plain number is read as bytes.
+func parseSize(size string) (uint64, error) {
+
+	value := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	multiplier := uint64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			multiplier = unit.bytes
+			break
+		}
+	}
+
+	n, err := strconv.ParseUint(value, 10, 64)
+	// Sizes which don't fit into 64 bits would silently wrap around
+	if err != nil || n > math.MaxUint64/multiplier {
+		return 0, fmt.Errorf("invalid size %q. expected a number with an optional K, M, G or T suffix", size)
+	}
+
+	return n * multiplier, nil
+}
+
+func formatSize(bytes uint64) string {
+
+	for _, unit := range sizeUnits {
+		if bytes >= unit.bytes {
+			return fmt.Sprintf("%.1f%s", float64(bytes)/float64(unit.bytes), unit.suffix)
+		}
+	}
+
+	return fmt.Sprintf("%dB", bytes)
+}
+
+// checkFreeDiskSpace returns an error if less than minFree bytes are available
+// for dir. The directory doesn't have to exist yet, the nearest existing
+// parent is checked instead.
+func checkFreeDiskSpace(dir string, minFree uint64) error {
+
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	free, err := freeDiskSpace(dir)
+	if err != nil {
+		return fmt.Errorf("failed to check free disk space: %w", err)
+	}
+
+	if free < minFree {
+		return fmt.Errorf("not enough free disk space in %s. %s available, %s required", dir, formatSize(free), formatSize(minFree))
+	}
+
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package cmd
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func diskFree(dir string) (uint64, error) {
+	return 0, fmt.Errorf("checking free disk space is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readEnvFile reads KEY=VALUE lines from the file at envPath. Blank lines and
+// lines starting with "#" are ignored. Like in shell scripts a line may start
+// with "export " and a value may be enclosed in single or double quotes. The
+// quotes are removed, anything within them is kept as it is.
+func readEnvFile(envPath string) ([]string, error) {
+
+	file, err := os.Open(envPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var env []string
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "export ") {
+			line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		}
+
+		i := strings.Index(line, "=")
+		if i <= 0 || strings.ContainsAny(line[:i], " \t") {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", envPath, lineNum)
+		}
+
+		key, value := line[:i], line[i+1:]
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		env = append(env, key+"="+value)
+	}
+
+	return env, scanner.Err()
+}
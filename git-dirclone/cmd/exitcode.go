@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	outcomeFailure = "failure"
+	outcomePartial = "partial"
+)
+
+// defaultExitCodes maps the outcome of a run to the exit code of the process.
+var defaultExitCodes = map[string]int{
+	outcomeFailure: 1,
+	outcomePartial: 2,
+}
+
+// exitCodeInterrupted is the exit code of runs stopped by an interrupt, the
+// same a shell reports for a process killed by SIGINT.
+const exitCodeInterrupted = 130
+
+// exitCodeError is returned for runs with failed clones to exit with the code
+// configured for the outcome of the run.
+type exitCodeError struct {
+	code int
+	err  error
+}
+
+func (e *exitCodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitCodeError) Unwrap() error {
+	return e.err
+}
+
+// exitCode returns the code the process should exit with for err.
+func exitCode(err error) int {
+
+	if err == nil {
+		return 0
+	}
+
+	var codeErr *exitCodeError
+	if errors.As(err, &codeErr) {
+		return codeErr.code
+	}
+
+	return 1
+}
+
+// validateExitCodes checks that codes only configures known outcomes with
+// valid exit codes and fills in defaults for the outcomes not configured.
+func validateExitCodes(codes map[string]int) (map[string]int, error) {
+
+	merged := make(map[string]int, len(defaultExitCodes))
+	for outcome, code := range defaultExitCodes {
+		merged[outcome] = code
+	}
+
+	for outcome, code := range codes {
+		if _, ok := defaultExitCodes[outcome]; !ok {
+			return nil, fmt.Errorf("unknown outcome %q in exit code map. expected %s or %s", outcome, outcomeFailure, outcomePartial)
+		}
+
+		// Exit statuses are truncated to a byte, 256 would silently become 0
+		if code < 0 || code > 255 {
+			return nil, fmt.Errorf("invalid exit code %d for %s. expected 0-255", code, outcome)
+		}
+
+		if outcome == outcomeFailure && code == 0 {
+			return nil, fmt.Errorf("invalid exit code 0 for %s. a run where every clone failed can't exit successfully", outcome)
+		}
+
+		merged[outcome] = code
+	}
+
+	return merged, nil
+}
@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// errIdleTimeout is returned when git was stopped for not producing output.
+var errIdleTimeout = errors.New("git produced no output")
+
+// errInterrupted is returned for clones stopped or skipped after an interrupt.
+var errInterrupted = errors.New("interrupted")
+
+// idleKillGrace is how long git gets to clean up after being interrupted
+// before it is killed.
+var idleKillGrace = 5 * time.Second
+
+// activityWriter forwards writes to w and signals each of them on activity.
+type activityWriter struct {
+	w        io.Writer
+	activity chan<- struct{}
+}
+
+func (a *activityWriter) Write(p []byte) (int, error) {
+	select {
+	case a.activity <- struct{}{}:
+	default:
+	}
+
+	return a.w.Write(p)
+}
+
+// runWithIdleTimeout runs gitCmd and stops it once it has not written any output
+// for the given timeout or interrupted is closed. A timeout of zero or less runs
+// the command without a limit.
+func runWithIdleTimeout(gitCmd *exec.Cmd, timeout time.Duration, interrupted <-chan struct{}) error {
+
+	if timeout <= 0 {
+		return gitCmd.Run()
+	}
+
+	activity := make(chan struct{}, 1)
+	gitCmd.Stdout = &activityWriter{w: gitCmd.Stdout, activity: activity}
+	gitCmd.Stderr = &activityWriter{w: gitCmd.Stderr, activity: activity}
+	setProcessGroup(gitCmd)
+
+	// git can't read from the terminal anymore. Fail on missing credentials
+	// instead of waiting for input that never comes
+	if gitCmd.Env == nil {
+		gitCmd.Env = os.Environ()
+	}
+	gitCmd.Env = append(gitCmd.Env, "GIT_TERMINAL_PROMPT=0")
+
+	if err := gitCmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- gitCmd.Wait()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-interrupted:
+			stopProcessGroup(gitCmd, done)
+			return errInterrupted
+		case <-activity:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(timeout)
+		case <-timer.C:
+			stopProcessGroup(gitCmd, done)
+			return fmt.Errorf("%w for %s and was stopped", errIdleTimeout, timeout)
+		}
+	}
+}
+
+// stopProcessGroup interrupts git and its helpers, which lets git remove a
+// partial clone, and kills whatever is left after idleKillGrace.
+func stopProcessGroup(gitCmd *exec.Cmd, done <-chan error) {
+
+	exited := false
+	if err := interruptProcessGroup(gitCmd); err == nil {
+		select {
+		case <-done:
+			exited = true
+		case <-time.After(idleKillGrace):
+		}
+	}
+
+	// Also reaches helpers like git-remote-https which outlived git
+	_ = killProcessGroup(gitCmd)
+
+	if !exited {
+		// Don't wait forever where only git itself could be killed and its
+		// helpers still hold the output pipes open
+		select {
+		case <-done:
+		case <-time.After(idleKillGrace):
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !solaris
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly,!solaris
+
+package cmd
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup is a no-op where process groups aren't available. Only git
+// itself is signaled there.
+func setProcessGroup(c *exec.Cmd) {}
+
+func interruptProcessGroup(c *exec.Cmd) error {
+	return c.Process.Signal(os.Interrupt)
+}
+
+func killProcessGroup(c *exec.Cmd) error {
+	return c.Process.Kill()
+}
@@ -1,14 +1,16 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
 	"github.com/spf13/cobra"
-	"github.com/whilp/git-urls"
 	"os"
 	"os/exec"
 	"os/user"
-	"path"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"time"
 )
 
 var (
@@ -21,8 +23,27 @@ func newRootCmd() *cobra.Command {
 		Use:   "git-dirclone",
 		Short: "git extension ",
 		Args:  cobra.MinimumNArgs(1),
+		// Execute prints errors itself, once and without cobra's prefix
+		SilenceErrors: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
 
+			// The arguments are fine from here on. Failed clones are no
+			// reason to show the usage
+			cmd.SilenceUsage = true
+
+			checkUpdate, err := cmd.PersistentFlags().GetBool("check-update")
+			if err != nil {
+				return err
+			}
+
+			if checkUpdate {
+				printUpdateNotice(cmd.ErrOrStderr(), cmd.Root().Version)
+			}
+
+			if _, err := exec.LookPath("git"); err != nil {
+				return fmt.Errorf("git executable not found in PATH. git-dirclone needs git to clone repositories")
+			}
+
 			rootDir, err := cmd.PersistentFlags().GetString("root")
 			if err != nil {
 				return err
@@ -33,27 +54,262 @@ func newRootCmd() *cobra.Command {
 				return err
 			}
 
-			urlObj, err := giturls.Parse(args[0])
+			baseDir, err := cmd.PersistentFlags().GetString("chdir")
 			if err != nil {
 				return err
 			}
 
-			gitCmd := exec.Command("git", "clone", args[0], path.Join(rootDir, urlObj.Host, strings.TrimSuffix(urlObj.Path, ".git")))
-			gitCmd.Stdout = os.Stdout
-			gitCmd.Stderr = os.Stderr
-			return gitCmd.Run()
+			baseDir, err = expandPathWithTilde(baseDir)
+			if err != nil {
+				return err
+			}
+
+			// Make the base absolute, so git running inside it doesn't resolve
+			// a relative base a second time
+			baseDir, err = filepath.Abs(baseDir)
+			if err != nil {
+				return err
+			}
+
+			if !filepath.IsAbs(rootDir) {
+				rootDir = filepath.Join(baseDir, rootDir)
+			}
+
+			token, err := lookupToken(cmd)
+			if err != nil {
+				return err
+			}
+
+			envFile, err := cmd.PersistentFlags().GetString("env-file")
+			if err != nil {
+				return err
+			}
+
+			var env []string
+			if envFile != "" {
+				envFile, err = expandPathWithTilde(envFile)
+				if err != nil {
+					return err
+				}
+
+				if !filepath.IsAbs(envFile) {
+					envFile = filepath.Join(baseDir, envFile)
+				}
+
+				env, err = readEnvFile(envFile)
+				if err != nil {
+					return err
+				}
+			}
+
+			idleTimeout, err := cmd.PersistentFlags().GetDuration("idle-timeout")
+			if err != nil {
+				return err
+			}
+
+			shallowSince, err := cmd.PersistentFlags().GetString("shallow-since")
+			if err != nil {
+				return err
+			}
+
+			if shallowSince != "" {
+				if err := validateDate(shallowSince); err != nil {
+					return err
+				}
+			}
+
+			cloneJobs, err := cmd.PersistentFlags().GetInt("clone-jobs")
+			if err != nil {
+				return err
+			}
+
+			recurseSubmodules, err := cmd.PersistentFlags().GetBool("recurse-submodules")
+			if err != nil {
+				return err
+			}
+
+			minFreeDiskFlag, err := cmd.PersistentFlags().GetString("min-free-disk")
+			if err != nil {
+				return err
+			}
+
+			var minFreeDisk uint64
+			if minFreeDiskFlag != "" {
+				minFreeDisk, err = parseSize(minFreeDiskFlag)
+				if err != nil {
+					return err
+				}
+			}
+
+			ciAnnotations, err := cmd.PersistentFlags().GetBool("ci-annotations")
+			if err != nil {
+				return err
+			}
+
+			exitCodes, err := cmd.PersistentFlags().GetStringToInt("exit-code-map")
+			if err != nil {
+				return err
+			}
+
+			exitCodes, err = validateExitCodes(exitCodes)
+			if err != nil {
+				return err
+			}
+
+			// Read last, so the hook never runs for an invalid invocation
+			preRunExec, err := cmd.PersistentFlags().GetString("pre-run-exec")
+			if err != nil {
+				return err
+			}
+
+			if preRunExec != "" {
+				// git clone would create the root later on. The hook runs in it,
+				// so it has to exist already on a first run
+				if err := os.MkdirAll(rootDir, 0755); err != nil {
+					return err
+				}
+
+				hookCmd := shellCommand(preRunExec)
+				hookCmd.Dir = rootDir
+				hookCmd.Stdout = cmd.OutOrStdout()
+				hookCmd.Stderr = cmd.ErrOrStderr()
+				if err := hookCmd.Run(); err != nil {
+					return fmt.Errorf("pre-run command failed: %w", err)
+				}
+			}
+
+			errs := cloneRepos(args, cloneJobs, cloneOptions{
+				rootDir:           rootDir,
+				baseDir:           baseDir,
+				token:             token,
+				env:               env,
+				idleTimeout:       idleTimeout,
+				shallowSince:      shallowSince,
+				recurseSubmodules: recurseSubmodules,
+				minFreeDisk:       minFreeDisk,
+				stdout:            cmd.OutOrStdout(),
+				stderr:            cmd.ErrOrStderr(),
+			})
+
+			var failed []string
+			for i, err := range errs {
+				if err != nil {
+					failed = append(failed, fmt.Sprintf("%s: %v", args[i], err))
+				}
+			}
+
+			if ciAnnotations {
+				provider := detectCIProvider()
+				for _, failure := range failed {
+					writeAnnotation(cmd.OutOrStdout(), provider, "error", failure)
+				}
+
+				if len(failed) > 0 && len(failed) < len(args) {
+					writeAnnotation(cmd.OutOrStdout(), provider, "warning", fmt.Sprintf("cloned %d of %d repositories", len(args)-len(failed), len(args)))
+				}
+			}
+
+			for _, err := range errs {
+				if errors.Is(err, errInterrupted) {
+					return &exitCodeError{code: exitCodeInterrupted, err: err}
+				}
+			}
+
+			switch {
+			case len(failed) == 0:
+				return nil
+			case len(args) == 1:
+				return &exitCodeError{code: exitCodes[outcomeFailure], err: errs[0]}
+			}
+
+			outcome := outcomePartial
+			if len(failed) == len(args) {
+				outcome = outcomeFailure
+			}
+
+			return &exitCodeError{
+				code: exitCodes[outcome],
+				err:  fmt.Errorf("failed to clone %d of %d repositories:\n%s", len(failed), len(args), strings.Join(failed, "\n")),
+			}
 		},
 	}
 
 	cmd.PersistentFlags().StringP("root", "r", os.Getenv("GIT_DIRCLONE_ROOT_DIR"), "root directory. default is environment variable GIT_DIRCLONE_ROOT_DIR")
+	cmd.PersistentFlags().Bool("ci-annotations", false, "print failed clones as CI annotations. supports GitHub Actions (default) and Azure Pipelines")
+	cmd.PersistentFlags().Bool("check-update", false, "print a notice if a newer release is available")
+	cmd.PersistentFlags().Int("clone-jobs", 1, "number of repositories cloned at the same time")
+	cmd.PersistentFlags().StringP("chdir", "C", "", "run as if started in this directory. relative root paths are resolved against it")
+	cmd.PersistentFlags().String("env-file", "", "file with KEY=VALUE lines added to the environment of git")
+	cmd.PersistentFlags().StringToInt("exit-code-map", defaultExitCodes, "exit codes per outcome. failure means all clones failed, partial means some did")
+	cmd.PersistentFlags().Duration("idle-timeout", 0, "stop git if it produces no output for this duration, e.g. 30s. git can't prompt for input while set. 0 disables it")
+	cmd.PersistentFlags().String("min-free-disk", "", "skip clones when less disk space is available in the root directory, e.g. 10G")
+	cmd.PersistentFlags().String("pre-run-exec", "", "shell command run in the root directory before cloning. the clone is aborted if it fails")
+	cmd.PersistentFlags().Bool("recurse-submodules", false, "initialize and check out submodules of the cloned repository")
+	cmd.PersistentFlags().String("shallow-since", "", "only clone history after this date. format is YYYY-MM-DD or RFC3339")
+	cmd.PersistentFlags().String("token", "", "token sent as bearer authorization header to https remotes")
+	cmd.PersistentFlags().String("token-env", "", "name of an environment variable holding the token. ignored if --token is set")
+
+	_ = cmd.MarkPersistentFlagDirname("root")
+	_ = cmd.MarkPersistentFlagDirname("chdir")
+	_ = cmd.MarkPersistentFlagFilename("env-file")
+
+	cmd.AddCommand(newCompletionCmd())
 
 	return cmd
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
-func Execute() {
-	cobra.CheckErr(rootCmd.Execute())
+func Execute(version string) {
+	rootCmd.Version = version
+
+	err := rootCmd.Execute()
+	if err == nil {
+		return
+	}
+
+	_, _ = fmt.Fprintln(os.Stderr, "Error:", err)
+	os.Exit(exitCode(err))
+}
+
+func lookupToken(cmd *cobra.Command) (string, error) {
+
+	token, err := cmd.PersistentFlags().GetString("token")
+	if err != nil || token != "" {
+		return token, err
+	}
+
+	tokenEnv, err := cmd.PersistentFlags().GetString("token-env")
+	if err != nil || tokenEnv == "" {
+		return "", err
+	}
+
+	token, ok := os.LookupEnv(tokenEnv)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", tokenEnv)
+	}
+
+	return token, nil
+}
+
+func shellCommand(command string) *exec.Cmd {
+
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+
+	return exec.Command("sh", "-c", command)
+}
+
+func validateDate(date string) error {
+
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if _, err := time.Parse(layout, date); err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid date %q. expected YYYY-MM-DD or RFC3339", date)
 }
 
 func expandPathWithTilde(rootDir string) (string, error) {
@@ -75,4 +331,4 @@ func expandPathWithTilde(rootDir string) (string, error) {
 	}
 
 	return rootDir, nil
-}
\ No newline at end of file
+}
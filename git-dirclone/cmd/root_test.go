@@ -1,9 +1,20 @@
 package cmd
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestRootCmd(t *testing.T) {
@@ -32,3 +43,1111 @@ func TestRootCmd(t *testing.T) {
 		t.Errorf("error while cleanup: %v", err)
 	}
 }
+
+// installGitStub puts a fake git executable running script first on PATH.
+// Every invocation appends its arguments, one per line, to the returned file.
+func installGitStub(t *testing.T, script string) string {
+	t.Helper()
+
+	binDir := t.TempDir()
+	argsFile := filepath.Join(binDir, "args")
+
+	content := fmt.Sprintf("#!/bin/sh\nprintf '%%s\\n' \"$@\" >> %q\n%s\n", argsFile, script)
+	if err := ioutil.WriteFile(filepath.Join(binDir, "git"), []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	oldPath := os.Getenv("PATH")
+	if err := os.Setenv("PATH", binDir+string(os.PathListSeparator)+oldPath); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.Setenv("PATH", oldPath)
+	})
+
+	return argsFile
+}
+
+func TestRootCmdToken(t *testing.T) {
+
+	secret := "s3cr3t-token"
+	envFile := filepath.Join(t.TempDir(), "env")
+	argsFile := installGitStub(t, fmt.Sprintf("env > %q; echo 'fatal: Authentication failed' >&2; exit 128", envFile))
+
+	// An existing config count, e.g. from --env-file, has to be kept
+	gitEnvFile := filepath.Join(t.TempDir(), "git.env")
+	if err := ioutil.WriteFile(gitEnvFile, []byte("GIT_CONFIG_COUNT=1\nGIT_CONFIG_KEY_0=core.askPass\nGIT_CONFIG_VALUE_0=\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := newRootCmd()
+
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetErr(&out)
+	cmd.SetArgs([]string{
+		fmt.Sprintf("--root=%s", t.TempDir()),
+		fmt.Sprintf("--token=%s", secret),
+		fmt.Sprintf("--env-file=%s", gitEnvFile),
+		"https://example.com/org/private.git",
+	})
+
+	if err := cmd.Execute(); err == nil {
+		t.Error("expected error from failing git invocation")
+	}
+
+	args, err := ioutil.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(args), secret) {
+		t.Errorf("expected token not to be visible in git's arguments. got args:\n%s", args)
+	}
+
+	env, err := ioutil.ReadFile(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(string(env), "\n")
+	for _, expected := range []string{
+		"GIT_CONFIG_COUNT=2",
+		"GIT_CONFIG_KEY_0=core.askPass",
+		"GIT_CONFIG_KEY_1=http.https://example.com/.extraHeader",
+		"GIT_CONFIG_VALUE_1=Authorization: Bearer " + secret,
+	} {
+		found := false
+		for _, line := range lines {
+			found = found || line == expected
+		}
+
+		if !found {
+			t.Errorf("expected %s in git environment. got:\n%s", expected, env)
+		}
+	}
+
+	if strings.Contains(out.String(), secret) {
+		t.Errorf("expected token not to be echoed. got output:\n%s", out.String())
+	}
+
+	cmd = newRootCmd()
+
+	cmd.SetOut(ioutil.Discard)
+	cmd.SetErr(ioutil.Discard)
+	cmd.SetArgs([]string{
+		fmt.Sprintf("--root=%s", t.TempDir()),
+		fmt.Sprintf("--token=%s", secret),
+		"http://example.com/org/private.git",
+	})
+
+	_ = cmd.Execute()
+
+	env, err = ioutil.ReadFile(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(env), secret) {
+		t.Errorf("expected token not to be sent to plain http remotes. got environment:\n%s", env)
+	}
+}
+
+func TestRootCmdChdir(t *testing.T) {
+
+	argsFile := installGitStub(t, "pwd > \"$(dirname \"$0\")/pwd\"")
+	baseDir := t.TempDir()
+
+	workDir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(workDir, "work"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	oldWd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(workDir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chdir(oldWd) }()
+
+	for _, tt := range []struct {
+		chdir           string
+		expectedBaseDir string
+	}{
+		{baseDir, baseDir},
+		{"work", filepath.Join(workDir, "work")},
+	} {
+		cmd := newRootCmd()
+
+		cmd.SetArgs([]string{
+			"-C", tt.chdir,
+			"--root=projects/src",
+			"https://example.com/org/repo.git",
+		})
+
+		if err := cmd.Execute(); err != nil {
+			t.Fatal(err)
+		}
+
+		args, err := ioutil.ReadFile(argsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedRepoPath := filepath.Join(tt.expectedBaseDir, "projects/src/example.com/org/repo")
+		if !strings.Contains(string(args), expectedRepoPath+"\n") {
+			t.Errorf("-C %s: expected repo to be cloned to %s. got args:\n%s", tt.chdir, expectedRepoPath, args)
+		}
+
+		pwd, err := ioutil.ReadFile(filepath.Join(filepath.Dir(argsFile), "pwd"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if evaluated, _ := filepath.EvalSymlinks(tt.expectedBaseDir); strings.TrimSpace(string(pwd)) != evaluated {
+			t.Errorf("-C %s: expected git to run in %s. got %s", tt.chdir, evaluated, pwd)
+		}
+
+		if err := os.Remove(argsFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRootCmdIdleTimeout(t *testing.T) {
+
+	ticksFile := filepath.Join(t.TempDir(), "ticks")
+	// Ignore interrupts to force the kill after the grace period, and leave a
+	// partial clone and a helper process behind like a hanging git would
+	argsFile := installGitStub(t, fmt.Sprintf(`trap '' INT
+for last; do :; done
+mkdir -p "$last/.git"
+(while :; do echo tick >> %q; sleep 0.05; done) &
+sleep 10`, ticksFile))
+
+	oldGrace := idleKillGrace
+	idleKillGrace = 200 * time.Millisecond
+	defer func() { idleKillGrace = oldGrace }()
+
+	rootDir := t.TempDir()
+	cmd := newRootCmd()
+
+	cmd.SetOut(ioutil.Discard)
+	cmd.SetErr(ioutil.Discard)
+	cmd.SetArgs([]string{
+		fmt.Sprintf("--root=%s", rootDir),
+		"--idle-timeout=200ms",
+		"https://example.com/org/repo.git",
+	})
+
+	start := time.Now()
+	err := cmd.Execute()
+	if err == nil || !strings.Contains(err.Error(), "no output") {
+		t.Errorf("expected idle timeout error. got: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected silent git to be killed after idle timeout. took %s", elapsed)
+	}
+
+	args, err := ioutil.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(args), "--progress\n") {
+		t.Errorf("expected --progress to be passed to git clone. got args:\n%s", args)
+	}
+
+	if _, err := os.Stat(filepath.Join(rootDir, "example.com/org/repo")); !os.IsNotExist(err) {
+		t.Errorf("expected partial clone to be removed. got: %v", err)
+	}
+
+	before, err := ioutil.ReadFile(ticksFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	after, err := ioutil.ReadFile(ticksFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(after) != len(before) {
+		t.Error("expected processes spawned by git to be killed as well")
+	}
+}
+
+func TestRootCmdIdleTimeoutInterrupt(t *testing.T) {
+
+	markerDir := t.TempDir()
+	ticksFile := filepath.Join(t.TempDir(), "ticks")
+	// The first clone exits on interrupts like git does, the second one ignores
+	// them and keeps a helper process running
+	installGitStub(t, fmt.Sprintf(`for last; do :; done
+mkdir -p "$last/.git"
+case "$last" in
+*/first)
+	touch %[1]q/first
+	sleep 10
+	;;
+*)
+	trap '' INT
+	(while :; do echo tick >> %[2]q; sleep 0.05; done) &
+	touch %[1]q/second
+	sleep 10
+	;;
+esac`, markerDir, ticksFile))
+
+	oldGrace := idleKillGrace
+	idleKillGrace = 200 * time.Millisecond
+	defer func() { idleKillGrace = oldGrace }()
+
+	rootDir := t.TempDir()
+	cmd := newRootCmd()
+
+	cmd.SetOut(ioutil.Discard)
+	cmd.SetErr(ioutil.Discard)
+	cmd.SetArgs([]string{
+		fmt.Sprintf("--root=%s", rootDir),
+		"--idle-timeout=10s",
+		"--clone-jobs=2",
+		"https://example.com/org/first.git",
+		"https://example.com/org/second.git",
+		"https://example.com/org/third.git",
+	})
+
+	go func() {
+		for i := 0; i < 100; i++ {
+			_, firstErr := os.Stat(filepath.Join(markerDir, "first"))
+			_, secondErr := os.Stat(filepath.Join(markerDir, "second"))
+			if firstErr == nil && secondErr == nil {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		if p, err := os.FindProcess(os.Getpid()); err == nil {
+			_ = p.Signal(os.Interrupt)
+		}
+	}()
+
+	start := time.Now()
+	err := cmd.Execute()
+	if code := exitCode(err); code != exitCodeInterrupted {
+		t.Errorf("expected exit code %d. got %d: %v", exitCodeInterrupted, code, err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected interrupted clones to be stopped. took %s", elapsed)
+	}
+
+	for _, name := range []string{"first", "second", "third"} {
+		if _, err := os.Stat(filepath.Join(rootDir, "example.com/org", name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed or never cloned. got: %v", name, err)
+		}
+	}
+
+	before, err := ioutil.ReadFile(ticksFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	after, err := ioutil.ReadFile(ticksFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(after) != len(before) {
+		t.Error("expected processes spawned by git to be killed as well")
+	}
+}
+
+func TestRootCmdIdleTimeoutNoPrompt(t *testing.T) {
+
+	if _, err := exec.LookPath("ps"); err != nil {
+		t.Skip("ps not available")
+	}
+
+	outFile := filepath.Join(t.TempDir(), "out")
+	installGitStub(t, fmt.Sprintf(`echo "prompt=$GIT_TERMINAL_PROMPT" > %[1]q
+echo "pid=$$ sid=$(ps -o sid= -p $$ | tr -d ' ')" >> %[1]q`, outFile))
+
+	cmd := newRootCmd()
+
+	cmd.SetOut(ioutil.Discard)
+	cmd.SetErr(ioutil.Discard)
+	cmd.SetArgs([]string{
+		fmt.Sprintf("--root=%s", t.TempDir()),
+		"--idle-timeout=10s",
+		"https://example.com/org/repo.git",
+	})
+
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ioutil.ReadFile(outFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected stub output:\n%s", out)
+	}
+
+	if lines[0] != "prompt=0" {
+		t.Errorf("expected terminal prompts to be disabled. got: %s", lines[0])
+	}
+
+	var pid, sid int
+	if _, err := fmt.Sscanf(lines[1], "pid=%d sid=%d", &pid, &sid); err != nil {
+		t.Fatalf("unexpected stub output %q: %v", lines[1], err)
+	}
+
+	// A session leader has no controlling terminal to be stopped by
+	if pid != sid {
+		t.Errorf("expected git to run in its own session. got pid %d in session %d", pid, sid)
+	}
+}
+
+// newFixtureRepo creates a bare repository with a single commit below dir and
+// returns its path.
+func newFixtureRepo(t *testing.T, dir string, name string) string {
+	t.Helper()
+
+	workDir := filepath.Join(t.TempDir(), "work")
+	bareDir := filepath.Join(dir, name)
+
+	runGit(t, "", "init", "-q", workDir)
+	runGit(t, workDir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "initial")
+	runGit(t, "", "clone", "-q", "--bare", workDir, bareDir)
+
+	return bareDir
+}
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	gitCmd := exec.Command("git", args...)
+	gitCmd.Dir = dir
+
+	out, err := gitCmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+
+	return string(out)
+}
+
+// newGitHTTPSServer serves the bare repositories below projectRoot over https.
+// The returned function lists the Authorization header of every request so far.
+func newGitHTTPSServer(t *testing.T, projectRoot string) (*httptest.Server, func() []string) {
+	t.Helper()
+
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+
+	var authHeaders []string
+	var mu sync.Mutex
+	backend := &cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + projectRoot, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		authHeaders = append(authHeaders, r.Header.Get("Authorization"))
+		mu.Unlock()
+		backend.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	// The test server uses a self-signed certificate
+	oldSSLNoVerify, hadSSLNoVerify := os.LookupEnv("GIT_SSL_NO_VERIFY")
+	if err := os.Setenv("GIT_SSL_NO_VERIFY", "1"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if hadSSLNoVerify {
+			_ = os.Setenv("GIT_SSL_NO_VERIFY", oldSSLNoVerify)
+		} else {
+			_ = os.Unsetenv("GIT_SSL_NO_VERIFY")
+		}
+	})
+
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return append([]string(nil), authHeaders...)
+	}
+}
+
+func TestRootCmdTokenNotPersisted(t *testing.T) {
+
+	secret := "s3cr3t-token"
+	projectRoot := t.TempDir()
+	newFixtureRepo(t, projectRoot, "repo.git")
+
+	server, authHeaders := newGitHTTPSServer(t, projectRoot)
+
+	rootDir := t.TempDir()
+	cmd := newRootCmd()
+
+	cmd.SetOut(ioutil.Discard)
+	cmd.SetErr(ioutil.Discard)
+	cmd.SetArgs([]string{
+		fmt.Sprintf("--root=%s", rootDir),
+		fmt.Sprintf("--token=%s", secret),
+		server.URL + "/repo.git",
+	})
+
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	headers := authHeaders()
+	if len(headers) == 0 {
+		t.Error("expected clone to reach the test server")
+	}
+	for _, header := range headers {
+		if header != "Bearer "+secret {
+			t.Errorf("expected every request to carry the token. got authorization header %q", header)
+		}
+	}
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := ioutil.ReadFile(filepath.Join(rootDir, serverURL.Host, "repo", ".git", "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(config), secret) || strings.Contains(string(config), "extraHeader") {
+		t.Errorf("expected token not to be persisted in repo config. got:\n%s", config)
+	}
+}
+
+func TestRootCmdEnvFile(t *testing.T) {
+
+	envDir := t.TempDir()
+	envFile := filepath.Join(envDir, "git.env")
+	envOut := filepath.Join(envDir, "out")
+
+	installGitStub(t, fmt.Sprintf("env > %q", envOut))
+
+	content := "# proxy settings\nHTTPS_PROXY=\"http://proxy.example.com:3128\"\n\nexport GIT_SSL_CAINFO=/etc/ssl/custom.pem\nGIT_AUTHOR_NAME='Jane \"JD\" Doe'\n"
+	if err := ioutil.WriteFile(envFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := newRootCmd()
+
+	cmd.SetArgs([]string{
+		fmt.Sprintf("--root=%s", t.TempDir()),
+		fmt.Sprintf("--env-file=%s", envFile),
+		"https://example.com/org/repo.git",
+	})
+
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := ioutil.ReadFile(envOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(string(env), "\n")
+	for _, expected := range []string{"HTTPS_PROXY=http://proxy.example.com:3128", "GIT_SSL_CAINFO=/etc/ssl/custom.pem", `GIT_AUTHOR_NAME=Jane "JD" Doe`, "PATH=" + os.Getenv("PATH")} {
+		found := false
+		for _, line := range lines {
+			found = found || line == expected
+		}
+
+		if !found {
+			t.Errorf("expected %s in git environment. got:\n%s", expected, env)
+		}
+	}
+
+	for _, invalid := range []string{"=value", "HTTPS_PROXY", "HTTPS PROXY=http://proxy.example.com:3128"} {
+		if err := ioutil.WriteFile(envFile, []byte("# proxy settings\n"+invalid+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		cmd := newRootCmd()
+
+		cmd.SetOut(ioutil.Discard)
+		cmd.SetErr(ioutil.Discard)
+		cmd.SetArgs([]string{
+			fmt.Sprintf("--root=%s", t.TempDir()),
+			fmt.Sprintf("--env-file=%s", envFile),
+			"https://example.com/org/repo.git",
+		})
+
+		if err := cmd.Execute(); err == nil || !strings.Contains(err.Error(), envFile+":2: expected KEY=VALUE") {
+			t.Errorf("%q: expected line-numbered error. got: %v", invalid, err)
+		}
+	}
+}
+
+func TestRootCmdShallowSince(t *testing.T) {
+
+	workDir := t.TempDir()
+	runGit(t, "", "init", "-q", workDir)
+	for _, date := range []string{"2010-01-01T00:00:00Z", "2021-06-01T00:00:00Z"} {
+		gitCmd := exec.Command("git", "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", date)
+		gitCmd.Dir = workDir
+		gitCmd.Env = append(os.Environ(), "GIT_AUTHOR_DATE="+date, "GIT_COMMITTER_DATE="+date)
+		if out, err := gitCmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+	}
+
+	bareDir := filepath.Join(t.TempDir(), "repo.git")
+	runGit(t, "", "clone", "-q", "--bare", workDir, bareDir)
+
+	rootDir := t.TempDir()
+	cmd := newRootCmd()
+
+	cmd.SetOut(ioutil.Discard)
+	cmd.SetErr(ioutil.Discard)
+	cmd.SetArgs([]string{
+		fmt.Sprintf("--root=%s", rootDir),
+		"--shallow-since=2020-01-01",
+		"file://" + bareDir,
+	})
+
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	count := runGit(t, filepath.Join(rootDir, strings.TrimSuffix(bareDir, ".git")), "rev-list", "--count", "HEAD")
+	if strings.TrimSpace(count) != "1" {
+		t.Errorf("expected only the commit after 2020-01-01 to be cloned. got %s commits", strings.TrimSpace(count))
+	}
+
+	cmd = newRootCmd()
+
+	cmd.SetOut(ioutil.Discard)
+	cmd.SetErr(ioutil.Discard)
+	cmd.SetArgs([]string{
+		fmt.Sprintf("--root=%s", t.TempDir()),
+		"--shallow-since=last tuesday",
+		"file://" + bareDir,
+	})
+
+	if err := cmd.Execute(); err == nil || !strings.Contains(err.Error(), "invalid date") {
+		t.Errorf("expected invalid date error. got: %v", err)
+	}
+}
+
+func TestRootCmdPreRunExec(t *testing.T) {
+
+	argsFile := installGitStub(t, "")
+	rootDir := t.TempDir()
+
+	cmd := newRootCmd()
+
+	cmd.SetOut(ioutil.Discard)
+	cmd.SetErr(ioutil.Discard)
+	cmd.SetArgs([]string{
+		fmt.Sprintf("--root=%s", rootDir),
+		"--pre-run-exec=touch pre-run-marker && exit 3",
+		"https://example.com/org/repo.git",
+	})
+
+	if err := cmd.Execute(); err == nil || !strings.Contains(err.Error(), "pre-run command failed") {
+		t.Errorf("expected pre-run command failure. got: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(rootDir, "pre-run-marker")); err != nil {
+		t.Errorf("expected pre-run command to run in root directory: %v", err)
+	}
+
+	if _, err := os.Stat(argsFile); !os.IsNotExist(err) {
+		t.Error("expected git not to be invoked after failing pre-run command")
+	}
+
+	argsFile = installGitStub(t, "")
+	rootDir = filepath.Join(t.TempDir(), "does", "not", "exist")
+
+	cmd = newRootCmd()
+
+	cmd.SetOut(ioutil.Discard)
+	cmd.SetErr(ioutil.Discard)
+	cmd.SetArgs([]string{
+		fmt.Sprintf("--root=%s", rootDir),
+		"--pre-run-exec=touch pre-run-marker",
+		"https://example.com/org/repo.git",
+	})
+
+	if err := cmd.Execute(); err != nil {
+		t.Errorf("expected pre-run command to run in a root which doesn't exist yet. got: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(rootDir, "pre-run-marker")); err != nil {
+		t.Errorf("expected pre-run command to run in root directory: %v", err)
+	}
+
+	if _, err := os.Stat(argsFile); err != nil {
+		t.Error("expected git to be invoked after successful pre-run command")
+	}
+
+	rootDir = t.TempDir()
+
+	cmd = newRootCmd()
+
+	cmd.SetOut(ioutil.Discard)
+	cmd.SetErr(ioutil.Discard)
+	cmd.SetArgs([]string{
+		fmt.Sprintf("--root=%s", rootDir),
+		"--pre-run-exec=touch pre-run-marker",
+		"--shallow-since=bogus",
+		"https://example.com/org/repo.git",
+	})
+
+	if err := cmd.Execute(); err == nil {
+		t.Error("expected error for invalid --shallow-since")
+	}
+
+	if _, err := os.Stat(filepath.Join(rootDir, "pre-run-marker")); !os.IsNotExist(err) {
+		t.Errorf("expected pre-run command not to run for invalid flags. got: %v", err)
+	}
+}
+
+func TestRootCmdCloneJobs(t *testing.T) {
+
+	stateDir := t.TempDir()
+	argsFile := installGitStub(t, fmt.Sprintf(`touch %[1]q/running.$$
+ls %[1]q | grep -c '^running' >> %[1]q/concurrency
+sleep 0.5
+rm %[1]q/running.$$`, stateDir))
+
+	cmd := newRootCmd()
+
+	cmd.SetArgs([]string{
+		fmt.Sprintf("--root=%s", t.TempDir()),
+		"--clone-jobs=2",
+		"https://example.com/org/one.git",
+		"https://example.com/org/two.git",
+		"https://example.com/org/three.git",
+		"https://example.com/org/four.git",
+	})
+
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	args, err := ioutil.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if clones := strings.Count(string(args), "clone\n"); clones != 4 {
+		t.Errorf("expected 4 clones. got %d", clones)
+	}
+
+	concurrency, err := ioutil.ReadFile(filepath.Join(stateDir, "concurrency"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, running := range strings.Fields(string(concurrency)) {
+		if running != "1" && running != "2" {
+			t.Errorf("expected at most 2 clones running at the same time. got %s", running)
+		}
+	}
+}
+
+func TestRootCmdExitCodeMap(t *testing.T) {
+
+	installGitStub(t, `case "$*" in *bad*) exit 128;; esac`)
+
+	tests := []struct {
+		name         string
+		urls         []string
+		exitCodeMap  string
+		expectedCode int
+	}{
+		{"success", []string{"https://example.com/org/good.git"}, "", 0},
+		{"single failure", []string{"https://example.com/org/bad.git"}, "", 1},
+		{"default partial", []string{"https://example.com/org/good.git", "https://example.com/org/bad.git"}, "", 2},
+		{"configured partial", []string{"https://example.com/org/good.git", "https://example.com/org/bad.git"}, "partial=3", 3},
+		{"configured failure", []string{"https://example.com/org/bad.git", "https://example.com/org/bad-too.git"}, "failure=4,partial=3", 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := newRootCmd()
+
+			cmd.SetOut(ioutil.Discard)
+			cmd.SetErr(ioutil.Discard)
+			args := []string{fmt.Sprintf("--root=%s", t.TempDir())}
+			if tt.exitCodeMap != "" {
+				args = append(args, "--exit-code-map="+tt.exitCodeMap)
+			}
+			cmd.SetArgs(append(args, tt.urls...))
+
+			if code := exitCode(cmd.Execute()); code != tt.expectedCode {
+				t.Errorf("expected exit code %d. got %d", tt.expectedCode, code)
+			}
+		})
+	}
+
+	for _, exitCodeMap := range []string{"failure=256", "partial=-1", "failure=0"} {
+		cmd := newRootCmd()
+
+		cmd.SetOut(ioutil.Discard)
+		cmd.SetErr(ioutil.Discard)
+		cmd.SetArgs([]string{
+			fmt.Sprintf("--root=%s", t.TempDir()),
+			"--exit-code-map=" + exitCodeMap,
+			"https://example.com/org/bad.git",
+		})
+
+		if err := cmd.Execute(); err == nil || !strings.Contains(err.Error(), "invalid exit code") {
+			t.Errorf("%s: expected invalid exit code error. got: %v", exitCodeMap, err)
+		}
+	}
+}
+
+func TestRootCmdCheckUpdate(t *testing.T) {
+
+	installGitStub(t, "")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `{"tag_name": "v1.3.0"}`)
+	}))
+	defer server.Close()
+
+	oldURL := latestReleaseURL
+	latestReleaseURL = server.URL
+	defer func() { latestReleaseURL = oldURL }()
+
+	for _, tt := range []struct {
+		version        string
+		expectedNotice bool
+	}{
+		{"1.2.4", true},
+		{"1.3.0", false},
+		{"dev", false},
+	} {
+		cmd := newRootCmd()
+		cmd.Version = tt.version
+
+		var stderr bytes.Buffer
+		cmd.SetErr(&stderr)
+		cmd.SetArgs([]string{
+			fmt.Sprintf("--root=%s", t.TempDir()),
+			"--check-update",
+			"https://example.com/org/repo.git",
+		})
+
+		if err := cmd.Execute(); err != nil {
+			t.Fatal(err)
+		}
+
+		if notice := strings.Contains(stderr.String(), "a newer version v1.3.0"); notice != tt.expectedNotice {
+			t.Errorf("version %s: expected notice %t. got output:\n%s", tt.version, tt.expectedNotice, stderr.String())
+		}
+	}
+}
+
+func TestRootCmdRecurseSubmodules(t *testing.T) {
+
+	fixtureDir := t.TempDir()
+	subDir := newFixtureRepo(t, fixtureDir, "sub.git")
+
+	workDir := filepath.Join(t.TempDir(), "work")
+	runGit(t, "", "init", "-q", workDir)
+	// Local submodule URLs are refused by default since git 2.38
+	runGit(t, workDir, "-c", "protocol.file.allow=always", "submodule", "add", "-q", subDir, "sub")
+	runGit(t, workDir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "add submodule")
+
+	superDir := filepath.Join(fixtureDir, "super.git")
+	runGit(t, "", "clone", "-q", "--bare", workDir, superDir)
+
+	envFile := filepath.Join(t.TempDir(), "git.env")
+	content := "GIT_CONFIG_COUNT=1\nGIT_CONFIG_KEY_0=protocol.file.allow\nGIT_CONFIG_VALUE_0=always\n"
+	if err := ioutil.WriteFile(envFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rootDir := t.TempDir()
+	cmd := newRootCmd()
+
+	cmd.SetOut(ioutil.Discard)
+	cmd.SetErr(ioutil.Discard)
+	cmd.SetArgs([]string{
+		fmt.Sprintf("--root=%s", rootDir),
+		fmt.Sprintf("--env-file=%s", envFile),
+		"--recurse-submodules",
+		"file://" + superDir,
+	})
+
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	clonedSub := filepath.Join(rootDir, strings.TrimSuffix(superDir, ".git"), "sub")
+	expectedHead := runGit(t, subDir, "rev-parse", "HEAD")
+	if head := runGit(t, clonedSub, "rev-parse", "HEAD"); head != expectedHead {
+		t.Errorf("expected submodule to be checked out at %s. got %s", expectedHead, head)
+	}
+}
+
+func TestRootCmdGitMissing(t *testing.T) {
+
+	oldPath := os.Getenv("PATH")
+	if err := os.Setenv("PATH", t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Setenv("PATH", oldPath) }()
+
+	cmd := newRootCmd()
+
+	cmd.SetOut(ioutil.Discard)
+	cmd.SetErr(ioutil.Discard)
+	cmd.SetArgs([]string{
+		fmt.Sprintf("--root=%s", t.TempDir()),
+		"https://example.com/org/repo.git",
+	})
+
+	if err := cmd.Execute(); err == nil || !strings.Contains(err.Error(), "git executable not found") {
+		t.Errorf("expected error naming the missing git executable. got: %v", err)
+	}
+}
+
+func TestRootCmdMinFreeDisk(t *testing.T) {
+
+	argsFile := installGitStub(t, "")
+
+	oldFreeDiskSpace := freeDiskSpace
+	freeDiskSpace = func(dir string) (uint64, error) {
+		return 512 << 20, nil
+	}
+	defer func() { freeDiskSpace = oldFreeDiskSpace }()
+
+	for _, tt := range []struct {
+		minFreeDisk   string
+		expectedClone bool
+	}{
+		{"1G", false},
+		{"256M", true},
+	} {
+		cmd := newRootCmd()
+
+		cmd.SetOut(ioutil.Discard)
+		cmd.SetErr(ioutil.Discard)
+		cmd.SetArgs([]string{
+			fmt.Sprintf("--root=%s", t.TempDir()),
+			"--min-free-disk=" + tt.minFreeDisk,
+			"https://example.com/org/repo.git",
+		})
+
+		err := cmd.Execute()
+		if tt.expectedClone && err != nil {
+			t.Errorf("min free disk %s: expected clone to succeed. got: %v", tt.minFreeDisk, err)
+		}
+		if !tt.expectedClone && (err == nil || !strings.Contains(err.Error(), "not enough free disk space")) {
+			t.Errorf("min free disk %s: expected free disk space error. got: %v", tt.minFreeDisk, err)
+		}
+
+		_, statErr := os.Stat(argsFile)
+		if cloned := statErr == nil; cloned != tt.expectedClone {
+			t.Errorf("min free disk %s: expected clone %t. got %t", tt.minFreeDisk, tt.expectedClone, cloned)
+		}
+	}
+
+	for _, minFreeDisk := range []string{"lots", "20000000T", "18446744073709551616"} {
+		cmd := newRootCmd()
+
+		cmd.SetOut(ioutil.Discard)
+		cmd.SetErr(ioutil.Discard)
+		cmd.SetArgs([]string{
+			fmt.Sprintf("--root=%s", t.TempDir()),
+			"--min-free-disk=" + minFreeDisk,
+			"https://example.com/org/repo.git",
+		})
+
+		if err := cmd.Execute(); err == nil || !strings.Contains(err.Error(), "invalid size") {
+			t.Errorf("min free disk %s: expected invalid size error. got: %v", minFreeDisk, err)
+		}
+	}
+}
+
+func TestCompletionCmd(t *testing.T) {
+
+	cmd := newRootCmd()
+
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"completion", "bash"})
+
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), "__start_git-dirclone") {
+		t.Errorf("expected bash completion script for git-dirclone. got:\n%s", out.String())
+	}
+}
+
+func TestRootCmdTokenNotSentToSubmodules(t *testing.T) {
+
+	secret := "s3cr3t-token"
+
+	subRoot := t.TempDir()
+	subDir := newFixtureRepo(t, subRoot, "sub.git")
+	subServer, subAuthHeaders := newGitHTTPSServer(t, subRoot)
+
+	workDir := filepath.Join(t.TempDir(), "work")
+	runGit(t, "", "init", "-q", workDir)
+	runGit(t, workDir, "-c", "protocol.file.allow=always", "submodule", "add", "-q", subDir, "sub")
+	// Point the submodule to another host than the superproject
+	runGit(t, workDir, "config", "-f", ".gitmodules", "submodule.sub.url", subServer.URL+"/sub.git")
+	runGit(t, workDir, "add", ".gitmodules")
+	runGit(t, workDir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "add submodule")
+
+	superRoot := t.TempDir()
+	runGit(t, "", "clone", "-q", "--bare", workDir, filepath.Join(superRoot, "super.git"))
+	superServer, superAuthHeaders := newGitHTTPSServer(t, superRoot)
+
+	rootDir := t.TempDir()
+	cmd := newRootCmd()
+
+	cmd.SetOut(ioutil.Discard)
+	cmd.SetErr(ioutil.Discard)
+	cmd.SetArgs([]string{
+		fmt.Sprintf("--root=%s", rootDir),
+		fmt.Sprintf("--token=%s", secret),
+		"--recurse-submodules",
+		superServer.URL + "/super.git",
+	})
+
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	superHeaders := superAuthHeaders()
+	if len(superHeaders) == 0 {
+		t.Error("expected clone to reach the superproject server")
+	}
+	for _, header := range superHeaders {
+		if header != "Bearer "+secret {
+			t.Errorf("expected every superproject request to carry the token. got authorization header %q", header)
+		}
+	}
+
+	subHeaders := subAuthHeaders()
+	if len(subHeaders) == 0 {
+		t.Error("expected submodule clone to reach the submodule server")
+	}
+	for _, header := range subHeaders {
+		if header != "" {
+			t.Errorf("expected submodule requests to carry no token. got authorization header %q", header)
+		}
+	}
+}
+
+func TestRootCmdErrorOutput(t *testing.T) {
+
+	installGitStub(t, "echo 'fatal: repository not found' >&2; exit 128")
+
+	cmd := newRootCmd()
+
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetErr(&out)
+	cmd.SetArgs([]string{
+		fmt.Sprintf("--root=%s", t.TempDir()),
+		"https://example.com/org/one.git",
+		"https://example.com/org/two.git",
+	})
+
+	if err := cmd.Execute(); err == nil {
+		t.Error("expected error for failed clones")
+	}
+
+	// Execute prints the error. Neither it nor the usage belong next to git's output
+	if strings.Contains(out.String(), "Error:") || strings.Contains(out.String(), "Usage:") {
+		t.Errorf("expected only git's output for failed clones. got:\n%s", out.String())
+	}
+
+	cmd = newRootCmd()
+
+	out.Reset()
+	cmd.SetOut(&out)
+	cmd.SetErr(&out)
+	cmd.SetArgs([]string{})
+
+	if err := cmd.Execute(); err == nil {
+		t.Error("expected error for missing arguments")
+	}
+
+	if !strings.Contains(out.String(), "Usage:") {
+		t.Errorf("expected usage for missing arguments. got:\n%s", out.String())
+	}
+}
+
+func TestRootCmdCIAnnotations(t *testing.T) {
+
+	installGitStub(t, `case "$*" in *bad*) exit 128;; esac`)
+
+	oldTFBuild, hadTFBuild := os.LookupEnv("TF_BUILD")
+	defer func() {
+		if hadTFBuild {
+			_ = os.Setenv("TF_BUILD", oldTFBuild)
+		} else {
+			_ = os.Unsetenv("TF_BUILD")
+		}
+	}()
+
+	for _, tt := range []struct {
+		tfBuild       string
+		expectedLines []string
+	}{
+		{"", []string{
+			"::error::https://example.com/org/bad.git: exit status 128",
+			"::warning::cloned 1 of 2 repositories",
+		}},
+		{"True", []string{
+			"##vso[task.logissue type=error]https://example.com/org/bad.git: exit status 128",
+			"##vso[task.logissue type=warning]cloned 1 of 2 repositories",
+		}},
+	} {
+		if err := os.Setenv("TF_BUILD", tt.tfBuild); err != nil {
+			t.Fatal(err)
+		}
+
+		cmd := newRootCmd()
+
+		var out bytes.Buffer
+		cmd.SetOut(&out)
+		cmd.SetErr(ioutil.Discard)
+		cmd.SetArgs([]string{
+			fmt.Sprintf("--root=%s", t.TempDir()),
+			"--ci-annotations",
+			"https://example.com/org/good.git",
+			"https://example.com/org/bad.git",
+		})
+
+		if err := cmd.Execute(); err == nil {
+			t.Error("expected error for failed clone")
+		}
+
+		if strings.TrimSpace(out.String()) != strings.Join(tt.expectedLines, "\n") {
+			t.Errorf("TF_BUILD=%q: expected annotations:\n%s\ngot:\n%s", tt.tfBuild, strings.Join(tt.expectedLines, "\n"), out.String())
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// latestReleaseURL is the GitHub API endpoint for the latest git-ext release
+var latestReleaseURL = "https://api.github.com/repos/dtomasi/git-ext/releases/latest"
+
+// fetchLatestVersion returns the tag of the latest git-ext release.
+func fetchLatestVersion(timeout time.Duration) (string, error) {
+
+	client := &http.Client{Timeout: timeout}
+
+	resp, err := client.Get(latestReleaseURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s from %s", resp.Status, latestReleaseURL)
+	}
+
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return "", err
+	}
+
+	return release.TagName, nil
+}
+
+// printUpdateNotice writes a one line notice to w if a release newer than
+// current exists. Errors are ignored, so being offline never breaks a clone.
+func printUpdateNotice(w io.Writer, current string) {
+
+	latest, err := fetchLatestVersion(3 * time.Second)
+	if err != nil || !isNewerVersion(latest, current) {
+		return
+	}
+
+	_, _ = fmt.Fprintf(w, "a newer version %s of git-ext is available (installed: %s). see https://github.com/dtomasi/git-ext#installation\n", latest, current)
+}
+
+// isNewerVersion reports whether latest is a higher semantic version than current.
+// Versions which can't be parsed, like "dev" builds, are never considered newer.
+func isNewerVersion(latest string, current string) bool {
+
+	latestParts, ok := parseVersion(latest)
+	if !ok {
+		return false
+	}
+
+	currentParts, ok := parseVersion(current)
+	if !ok {
+		return false
+	}
+
+	for i := range latestParts {
+		if latestParts[i] != currentParts[i] {
+			return latestParts[i] > currentParts[i]
+		}
+	}
+
+	return false
+}
+
+func parseVersion(version string) ([3]int, bool) {
+
+	var parts [3]int
+
+	version = strings.TrimPrefix(version, "v")
+	// Pre-release and build metadata are not taken into account
+	version = strings.SplitN(version, "-", 2)[0]
+	version = strings.SplitN(version, "+", 2)[0]
+
+	fields := strings.Split(version, ".")
+	if len(fields) != 3 {
+		return parts, false
+	}
+
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return parts, false
+		}
+		parts[i] = n
+	}
+
+	return parts, true
+}
@@ -2,6 +2,9 @@ package main
 
 import "github.com/dtomasi/git-ext/git-dirclone/cmd"
 
+// version is set by goreleaser at build time
+var version = "dev"
+
 func main() {
-	cmd.Execute()
+	cmd.Execute(version)
 }